@@ -0,0 +1,54 @@
+package http
+
+import (
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"regexp"
+)
+
+// ecsCredentialsRegex matches the ECS task-metadata credentials path
+// containers are pointed at via AWS_CONTAINER_CREDENTIALS_RELATIVE_URI, e.g.
+// /v2/credentials/<uuid>. Unlike the EC2 meta-data/ tree, the UUID itself is
+// the secret a task is handed at launch, so it is looked up directly rather
+// than via containerStore.IAMRoleForIP.
+var ecsCredentialsRegex = regexp.MustCompile("^/v2/credentials/([^/]+)$")
+
+// ECSRoleLookup resolves the IAM role a task should be issued credentials
+// for, given the unique credentials-path UUID it was launched with.
+type ECSRoleLookup interface {
+	RoleForCredentialsUUID(uuid string) (string, error)
+}
+
+// WithECSRoleLookup enables the ECS task-role route at
+// /v2/credentials/<uuid>, resolving the caller via lookup instead of IP.
+// Pair it with WithCredentialEncoder(ecsCredentialEncoder{}) so the route
+// actually serves the ECS JSON dialect clients expect.
+func WithECSRoleLookup(lookup ECSRoleLookup) HandlerOption {
+	return func(handler *httpHandler) {
+		handler.ecsLookup = lookup
+	}
+}
+
+// serveECSCredentialsRequest is the handler for the /v2/credentials/<uuid>
+// route; it only runs when WithECSRoleLookup has been configured.
+func (handler *httpHandler) serveECSCredentialsRequest(writer http.ResponseWriter, uuid string, logger *logrus.Entry) {
+	role, err := handler.ecsLookup.RoleForCredentialsUUID(uuid)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to resolve IAM role for ECS credentials UUID")
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	logger = logger.WithFields(logrus.Fields{"role": role})
+	creds, err := handler.credentialStore.CredentialsForRole(role)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to find credentials")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := handler.encoder.Encode(writer, role, creds); err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to encode credentials")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Successfully responded")
+}
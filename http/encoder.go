@@ -0,0 +1,142 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/swipely/iam-docker/iam"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// CredentialEncoder writes a successful credential lookup to the response in
+// whatever shape a particular client expects. Implementations let iam-docker
+// speak the classic EC2 IMDS dialect, the ECS task-role dialect, or the
+// EKS/IRSA process-credentials dialect from the same daemon.
+type CredentialEncoder interface {
+	Encode(writer http.ResponseWriter, role string, creds *sts.Credentials) error
+}
+
+// credentialResponse is the classic EC2 instance-metadata IAM credential
+// document shape.
+type credentialResponse struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	Code            string
+	Expiration      time.Time
+	LastUpdated     time.Time
+	SecretAccessKey string
+	Token           string
+	Type            string
+}
+
+// ec2CredentialEncoder is the default encoder and reproduces the behaviour
+// iam-docker has always had: the JSON document served under
+// meta-data/iam/security-credentials/<role>.
+type ec2CredentialEncoder struct{}
+
+func (ec2CredentialEncoder) Encode(writer http.ResponseWriter, role string, creds *sts.Credentials) error {
+	response, err := json.Marshal(&credentialResponse{
+		AccessKeyID:     *creds.AccessKeyId,
+		Code:            credentialCode,
+		Expiration:      *creds.Expiration,
+		LastUpdated:     creds.Expiration.Add(-1 * time.Hour),
+		SecretAccessKey: *creds.SecretAccessKey,
+		Type:            credentialType,
+		Token:           *creds.SessionToken,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(response)
+	return err
+}
+
+// ecsCredentialResponse is the shape the ECS agent serves at
+// http://169.254.170.2/v2/credentials/<uuid>, referenced by containers via
+// the AWS_CONTAINER_CREDENTIALS_RELATIVE_URI environment variable.
+type ecsCredentialResponse struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+	RoleArn         string
+}
+
+// ecsCredentialEncoder serves the ECS task-role JSON dialect, for use when
+// iam-docker is fronting AWS_CONTAINER_CREDENTIALS_RELATIVE_URI instead of
+// the EC2 metadata endpoint.
+type ecsCredentialEncoder struct{}
+
+func (ecsCredentialEncoder) Encode(writer http.ResponseWriter, role string, creds *sts.Credentials) error {
+	response, err := json.Marshal(&ecsCredentialResponse{
+		AccessKeyID:     *creds.AccessKeyId,
+		SecretAccessKey: *creds.SecretAccessKey,
+		Token:           *creds.SessionToken,
+		Expiration:      *creds.Expiration,
+		RoleArn:         role,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(response)
+	return err
+}
+
+// WriteWebIdentityCredentialsFile renders role's credentials in the
+// credential_process JSON dialect and writes them to path. An EKS/IRSA-style
+// pod normally exchanges the JWT named by AWS_WEB_IDENTITY_TOKEN_FILE for
+// credentials itself; there's no HTTP request to route for that flow, so
+// iam-docker instead does the exchange on the caller's behalf and refreshes
+// this file, which an SDK can then point its own `credential_process`
+// config at. Callers are expected to invoke this on a schedule comfortably
+// inside the credentials' lifetime.
+func WriteWebIdentityCredentialsFile(path string, role string, credentialStore iam.CredentialStore) error {
+	creds, err := credentialStore.CredentialsForRole(role)
+	if err != nil {
+		return err
+	}
+	response, err := json.Marshal(&processCredentialResponse{
+		Version:         1,
+		AccessKeyID:     *creds.AccessKeyId,
+		SecretAccessKey: *creds.SecretAccessKey,
+		SessionToken:    *creds.SessionToken,
+		Expiration:      *creds.Expiration,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, response, 0600)
+}
+
+// processCredentialResponse is the JSON document the AWS SDKs' external
+// "credential_process" provider expects (Version 1). It's the natural
+// format for an EKS/IRSA-style integration, where a pod would otherwise read
+// a JWT from AWS_WEB_IDENTITY_TOKEN_FILE and exchange it for credentials
+// itself; here iam-docker does that exchange and hands back the result in
+// the same shape.
+type processCredentialResponse struct {
+	Version         int
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// eksCredentialEncoder serves the credential_process/IRSA-style JSON
+// dialect.
+type eksCredentialEncoder struct{}
+
+func (eksCredentialEncoder) Encode(writer http.ResponseWriter, role string, creds *sts.Credentials) error {
+	response, err := json.Marshal(&processCredentialResponse{
+		Version:         1,
+		AccessKeyID:     *creds.AccessKeyId,
+		SecretAccessKey: *creds.SecretAccessKey,
+		SessionToken:    *creds.SessionToken,
+		Expiration:      *creds.Expiration,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(response)
+	return err
+}
@@ -1,7 +1,6 @@
 package http
 
 import (
-	"encoding/json"
 	"github.com/Sirupsen/logrus"
 	"github.com/swipely/iam-docker/docker"
 	"github.com/swipely/iam-docker/iam"
@@ -9,7 +8,6 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"regexp"
-	"time"
 )
 
 const (
@@ -19,20 +17,92 @@ const (
 )
 
 var (
-	iamRegex = regexp.MustCompile("^/[^/]+/meta-data/iam/security-credentials/")
+	iamRegex = regexp.MustCompile("^/[^/]+/meta-data/iam/security-credentials/(.*)$")
 	log      = logrus.WithFields(logrus.Fields{"package": "http"})
 )
 
-// NewIAMHandler creates a http.Handler which responds to metadata API requests.
-// When the request is for the IAM path, it looks up the IAM role in the
-// container store and fetches those credentials. Otherwise, it acts as a
-// reverse proxy for the real API.
-func NewIAMHandler(upstream *url.URL, containerStore docker.ContainerStore, credentialStore iam.CredentialStore) http.Handler {
-	return &httpHandler{
+// HandlerOption configures optional behaviour of the handler NewIAMHandler
+// returns. The containerStore and credentialStore given to NewIAMHandler
+// remain mandatory since every strategy ultimately needs somewhere to look
+// up a role and somewhere to fetch credentials for it.
+type HandlerOption func(*httpHandler)
+
+// WithUpstream makes the handler reverse-proxy any request it doesn't
+// otherwise understand to upstream. Without this option the daemon runs
+// standalone (e.g. --no-upstream) and such requests 404, which is what
+// lets it run off a real EC2 host.
+func WithUpstream(upstream *url.URL) HandlerOption {
+	return func(handler *httpHandler) {
+		if upstream != nil {
+			handler.reverseProxy = httputil.NewSingleHostReverseProxy(upstream)
+		}
+	}
+}
+
+// WithMetadata supplies the values the mock instance metadata service in
+// metadata.go serves.
+func WithMetadata(metadata MetadataConfig) HandlerOption {
+	return func(handler *httpHandler) {
+		handler.metadata = metadata
+	}
+}
+
+// WithIMDSVersion selects how the IMDSv2 token handshake is enforced and
+// should be one of "v1", "v2", or "both"; unrecognised values fall back to
+// "both".
+func WithIMDSVersion(flag string) HandlerOption {
+	return func(handler *httpHandler) {
+		handler.imdsVersion = parseIMDSVersion(flag)
+	}
+}
+
+// WithCredentialEncoder overrides the dialect credentials are served in,
+// e.g. ecsCredentialEncoder{} or eksCredentialEncoder{} in place of the
+// default classic EC2 IMDS JSON.
+func WithCredentialEncoder(encoder CredentialEncoder) HandlerOption {
+	return func(handler *httpHandler) {
+		handler.encoder = encoder
+	}
+}
+
+// WithIdentityResolver overrides how the handler maps an inbound request to
+// an IAM role, e.g. peerCredIdentityResolver{} or tokenIdentityResolver{} in
+// place of the default remote-IP lookup.
+func WithIdentityResolver(resolver IdentityResolver) HandlerOption {
+	return func(handler *httpHandler) {
+		handler.identity = resolver
+	}
+}
+
+func parseIMDSVersion(flag string) imdsVersion {
+	switch imdsVersion(flag) {
+	case imdsV1, imdsV2:
+		return imdsVersion(flag)
+	default:
+		return imdsBoth
+	}
+}
+
+// NewIAMHandler creates a http.Handler which responds to metadata API
+// requests. When the request is for the IAM security-credentials path, it
+// resolves the caller's IAM role via identity (by default, remote-IP lookup
+// through containerStore) and encodes the fetched credentials via encoder
+// (by default, classic EC2 IMDS JSON). Other meta-data/ paths are served
+// from the mock instance metadata registry in metadata.go. See the With*
+// options for overriding any of this.
+func NewIAMHandler(containerStore docker.ContainerStore, credentialStore iam.CredentialStore, options ...HandlerOption) http.Handler {
+	handler := &httpHandler{
 		containerStore:  containerStore,
 		credentialStore: credentialStore,
-		reverseProxy:    httputil.NewSingleHostReverseProxy(upstream),
+		encoder:         ec2CredentialEncoder{},
+		identity:        ipIdentityResolver{containerStore: containerStore},
+		imdsVersion:     imdsBoth,
+		tokens:          newTokenStore(),
+	}
+	for _, option := range options {
+		option(handler)
 	}
+	return handler
 }
 
 func (handler *httpHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -40,27 +110,87 @@ func (handler *httpHandler) ServeHTTP(writer http.ResponseWriter, request *http.
 		"path":   request.URL.Path,
 		"method": request.Method,
 	})
-	if (request.Method == iamMethod) && iamRegex.MatchString(request.URL.Path) {
+	if (request.Method == tokenMethod) && tokenPathRegex.MatchString(request.URL.Path) {
+		logger.Info("Serving IMDSv2 token request")
+		handler.serveTokenRequest(writer, request, logger)
+		return
+	}
+	if groups := iamRegex.FindStringSubmatch(request.URL.Path); (request.Method == iamMethod) && groups != nil {
+		if handler.requiresValidToken(request) {
+			logger.Warn("Rejecting IAM request without a valid IMDSv2 token")
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 		logger.Info("Serving IAM credentials request")
-		handler.serveIAMRequest(writer, request, logger)
-	} else {
-		logger.Info("Serving reverse proxy request")
-		handler.reverseProxy.ServeHTTP(writer, request)
+		handler.serveIAMRequest(writer, request, groups[1], logger)
+		return
+	}
+	if groups := ecsCredentialsRegex.FindStringSubmatch(request.URL.Path); (request.Method == iamMethod) && groups != nil && handler.ecsLookup != nil {
+		logger.Info("Serving ECS task-role credentials request")
+		handler.serveECSCredentialsRequest(writer, groups[1], logger)
+		return
 	}
+	if groups := metaDataRegex.FindStringSubmatch(request.URL.Path); (request.Method == iamMethod) && groups != nil {
+		if handler.requiresValidToken(request) {
+			logger.Warn("Rejecting metadata request without a valid IMDSv2 token")
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		logger.Info("Serving mock metadata request")
+		role, err := handler.identity.ResolveRole(request)
+		roleResolved := err == nil
+		if !roleResolved {
+			logger.WithFields(logrus.Fields{"error": err.Error()}).Debug("No IAM role for caller, serving defaults")
+		}
+		handler.serveMetadataRequest(writer, request, groups[1], role, roleResolved, logger)
+		return
+	}
+	if handler.reverseProxy == nil {
+		logger.Warn("No upstream configured, returning 404")
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	logger.Info("Serving reverse proxy request")
+	// The caller's token, if any, was minted by and is only meaningful to
+	// this daemon's own tokenStore; forwarding it verbatim would hand a real
+	// upstream IMDS a header it can't validate, so strip it. Token PUTs are
+	// always answered locally above, so upstream receives these requests
+	// without any token, as IMDSv1 requests.
+	request.Header.Del(tokenHeader)
+	handler.reverseProxy.ServeHTTP(writer, request)
 }
 
-func (handler *httpHandler) serveIAMRequest(writer http.ResponseWriter, request *http.Request, logger *logrus.Entry) {
+// serveIAMRequest implements the two-step role discovery real EC2 clients
+// perform: a GET with an empty subpath returns just the role name as plain
+// text, and a GET whose subpath names that role (optionally with a trailing
+// slash) returns the encoded credentials. Any other subpath 404s, matching
+// the behaviour documented in ec2metaproxy.
+func (handler *httpHandler) serveIAMRequest(writer http.ResponseWriter, request *http.Request, subpath string, logger *logrus.Entry) {
 	logger = logger.WithFields(logrus.Fields{"remoteAddr": request.RemoteAddr})
-	logger.Debug("Fetching IAM role")
-	role, err := handler.containerStore.IAMRoleForIP(request.RemoteAddr)
+	logger.Debug("Resolving caller identity")
+	role, err := handler.identity.ResolveRole(request)
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Warn("Unable to find IAM role")
+		}).Warn("Unable to resolve IAM role")
 		writer.WriteHeader(http.StatusNotFound)
 		return
 	}
 	logger = logger.WithFields(logrus.Fields{"role": role})
+	if subpath == "" {
+		logger.Debug("Responding with role name")
+		if _, err := writer.Write([]byte(role)); err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Warn("Unable to write response")
+		}
+		return
+	}
+	if subpath != role && subpath != role+"/" {
+		logger.WithFields(logrus.Fields{"subpath": subpath}).Warn("Subpath does not match role")
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
 	logger.Debug("Fetching credentials")
 	creds, err := handler.credentialStore.CredentialsForRole(role)
 	if err != nil {
@@ -70,44 +200,24 @@ func (handler *httpHandler) serveIAMRequest(writer http.ResponseWriter, request
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	response, err := json.Marshal(&credentialResponse{
-		AccessKeyID:     *creds.AccessKeyId,
-		Code:            credentialCode,
-		Expiration:      *creds.Expiration,
-		LastUpdated:     creds.Expiration.Add(-1 * time.Hour),
-		SecretAccessKey: *creds.SecretAccessKey,
-		Type:            credentialType,
-		Token:           *creds.SessionToken,
-	})
-	if err != nil {
+	if err := handler.encoder.Encode(writer, role, creds); err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Warn("Unable to serialize JSON")
+		}).Warn("Unable to encode credentials")
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	_, err = writer.Write(response)
-	if err != nil {
-		logger.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Warn("Unable to write response")
-		return
-	}
 	logger.Info("Successfully responded")
 }
 
-type credentialResponse struct {
-	AccessKeyID     string `json:"AccessKeyId"`
-	Code            string
-	Expiration      time.Time
-	LastUpdated     time.Time
-	SecretAccessKey string
-	Token           string
-	Type            string
-}
-
 type httpHandler struct {
 	containerStore  docker.ContainerStore
 	credentialStore iam.CredentialStore
 	reverseProxy    http.Handler
+	metadata        MetadataConfig
+	imdsVersion     imdsVersion
+	tokens          *tokenStore
+	encoder         CredentialEncoder
+	identity        IdentityResolver
+	ecsLookup       ECSRoleLookup
 }
@@ -0,0 +1,109 @@
+package http
+
+import (
+	"errors"
+	"github.com/swipely/iam-docker/docker"
+	"net/http"
+	"strings"
+)
+
+// IdentityResolver determines which IAM role a request should be served
+// credentials for. Implementations let the daemon identify callers by
+// source IP (the original behaviour, fragile on host-networked or overlay
+// networks where several containers can share an address), by Unix-socket
+// peer credentials, or by a token the container was handed at start time.
+type IdentityResolver interface {
+	ResolveRole(request *http.Request) (string, error)
+}
+
+// ipIdentityResolver is the resolver iam-docker has always used: it looks up
+// the role bound to the container whose address matches request.RemoteAddr.
+type ipIdentityResolver struct {
+	containerStore docker.ContainerStore
+}
+
+func (resolver ipIdentityResolver) ResolveRole(request *http.Request) (string, error) {
+	return resolver.containerStore.IAMRoleForIP(request.RemoteAddr)
+}
+
+// peerCredContextKey is the context key PeerCredConnContext (peercred_linux.go)
+// uses to stash the *peerCredentials captured for a connection when the
+// daemon is bound to a Unix socket, since net/http gives handlers no other
+// way to reach the underlying net.Conn.
+type peerCredContextKey struct{}
+
+// peerCredentials holds the SO_PEERCRED-derived identity of the process on
+// the other end of a Unix socket connection.
+type peerCredentials struct {
+	PID int
+	UID int
+	GID int
+}
+
+// PIDRoleLookup looks up the IAM role bound to the container that owns the
+// given PID. docker.ContainerStore has no such method yet (it only resolves
+// by IP), so this is a separate, narrower interface an operator can satisfy
+// with an adapter once PID-namespace lookups land in that package, the same
+// way TokenIssuer below is kept independent of docker.ContainerStore.
+type PIDRoleLookup interface {
+	IAMRoleForPID(pid int) (string, error)
+}
+
+// peerCredIdentityResolver identifies the caller by the PID namespace of the
+// process holding the other end of a Unix socket connection rather than by
+// IP, which makes it usable from inside each container when the socket is
+// bind-mounted in, even on host-networked or overlay-networked containers.
+// It relies on PeerCredConnContext (peercred_linux.go) having populated the
+// request's context; bind that as the http.Server's ConnContext when using
+// this resolver, or ResolveRole will always error.
+type peerCredIdentityResolver struct {
+	lookup PIDRoleLookup
+}
+
+// NewPeerCredIdentityResolver returns an IdentityResolver that identifies
+// callers by the SO_PEERCRED PID of their Unix-socket connection. Use it
+// with WithIdentityResolver, and bind PeerCredConnContext as the
+// http.Server's ConnContext so that PID is actually available.
+func NewPeerCredIdentityResolver(lookup PIDRoleLookup) IdentityResolver {
+	return peerCredIdentityResolver{lookup: lookup}
+}
+
+func (resolver peerCredIdentityResolver) ResolveRole(request *http.Request) (string, error) {
+	creds, ok := request.Context().Value(peerCredContextKey{}).(*peerCredentials)
+	if !ok || creds == nil {
+		return "", errors.New("no peer credentials available for this connection")
+	}
+	return resolver.lookup.IAMRoleForPID(creds.PID)
+}
+
+// TokenIssuer looks up the IAM role bound to a token handed to a container
+// at start time (typically injected as an env var) and returns an error if
+// the token is unknown or has been revoked.
+type TokenIssuer interface {
+	RoleForToken(token string) (string, error)
+}
+
+// tokenHeaderName is the header containers present the token they were
+// issued at start in.
+const tokenHeaderName = "X-Iam-Docker-Token"
+
+// tokenIdentityResolver identifies the caller by an HMAC token issued when
+// the container started, rather than by network identity at all.
+type tokenIdentityResolver struct {
+	tokens TokenIssuer
+}
+
+// NewTokenIdentityResolver returns an IdentityResolver that identifies
+// callers by the HMAC token issued to their container at start time and
+// injected as an env var. Use it with WithIdentityResolver.
+func NewTokenIdentityResolver(tokens TokenIssuer) IdentityResolver {
+	return tokenIdentityResolver{tokens: tokens}
+}
+
+func (resolver tokenIdentityResolver) ResolveRole(request *http.Request) (string, error) {
+	token := strings.TrimSpace(request.Header.Get(tokenHeaderName))
+	if token == "" {
+		return "", errors.New("missing " + tokenHeaderName + " header")
+	}
+	return resolver.tokens.RoleForToken(token)
+}
@@ -0,0 +1,218 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// InstanceMetadata holds the values returned for the EC2 instance metadata
+// paths under /latest/meta-data/. It is intentionally a flat struct rather
+// than a map so that the zero value of each field is meaningful when merging
+// a per-container override on top of the daemon-wide default.
+type InstanceMetadata struct {
+	InstanceID       string
+	InstanceType     string
+	LocalIPv4        string
+	PublicIPv4       string
+	Mac              string
+	AvailabilityZone string
+	Region           string
+	Hostname         string
+}
+
+// MetadataConfig describes the values the mock metadata service hands back.
+// Default is used for any container that has no role-specific override;
+// Overrides is keyed by IAM role name (as resolved by the handler's
+// IdentityResolver, by default docker.ContainerStore.IAMRoleForIP) so that
+// distinct containers can appear to be distinct instances.
+type MetadataConfig struct {
+	Default   InstanceMetadata
+	Overrides map[string]InstanceMetadata
+}
+
+// forRole returns the InstanceMetadata that should be served to a container
+// which resolved to the given IAM role, falling back to Default for any
+// field the override leaves blank.
+func (config MetadataConfig) forRole(role string) InstanceMetadata {
+	override, ok := config.Overrides[role]
+	if !ok {
+		return config.Default
+	}
+	return mergeMetadata(config.Default, override)
+}
+
+func mergeMetadata(base, override InstanceMetadata) InstanceMetadata {
+	merged := base
+	if override.InstanceID != "" {
+		merged.InstanceID = override.InstanceID
+	}
+	if override.InstanceType != "" {
+		merged.InstanceType = override.InstanceType
+	}
+	if override.LocalIPv4 != "" {
+		merged.LocalIPv4 = override.LocalIPv4
+	}
+	if override.PublicIPv4 != "" {
+		merged.PublicIPv4 = override.PublicIPv4
+	}
+	if override.Mac != "" {
+		merged.Mac = override.Mac
+	}
+	if override.AvailabilityZone != "" {
+		merged.AvailabilityZone = override.AvailabilityZone
+	}
+	if override.Region != "" {
+		merged.Region = override.Region
+	}
+	if override.Hostname != "" {
+		merged.Hostname = override.Hostname
+	}
+	return merged
+}
+
+// metaDataRegex recognises any request under /<version>/meta-data/ so it can
+// be routed through the metadataRegistry rather than the reverse proxy.
+var metaDataRegex = regexp.MustCompile("^/[^/]+/meta-data/?(.*)$")
+
+// metadataEntry pairs a path (relative to meta-data/) with the function that
+// produces its body. entries are matched in order, first match wins, so more
+// specific patterns must be registered before their prefixes.
+type metadataEntry struct {
+	pattern *regexp.Regexp
+	fetch   func(md InstanceMetadata, groups []string) (string, bool)
+}
+
+// metadataRegistry is the set of endpoint handlers the mock metadata service
+// understands. It covers the paths the AWS SDKs probe on startup; anything
+// else 404s rather than silently proxying upstream.
+var metadataRegistry = []metadataEntry{
+	{regexp.MustCompile(`^$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return strings.Join([]string{
+			"hostname",
+			"iam/",
+			"instance-id",
+			"instance-type",
+			"local-ipv4",
+			"mac",
+			"network/",
+			"placement/",
+			"public-ipv4",
+		}, "\n"), true
+	}},
+	{regexp.MustCompile(`^instance-id$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return md.InstanceID, true
+	}},
+	{regexp.MustCompile(`^instance-type$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return md.InstanceType, true
+	}},
+	{regexp.MustCompile(`^local-ipv4$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return md.LocalIPv4, true
+	}},
+	{regexp.MustCompile(`^public-ipv4$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return md.PublicIPv4, true
+	}},
+	{regexp.MustCompile(`^mac$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return md.Mac, true
+	}},
+	{regexp.MustCompile(`^hostname$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return md.Hostname, true
+	}},
+	{regexp.MustCompile(`^placement/?$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return "availability-zone\nregion", true
+	}},
+	{regexp.MustCompile(`^placement/availability-zone$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return md.AvailabilityZone, true
+	}},
+	{regexp.MustCompile(`^placement/region$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return md.Region, true
+	}},
+	{regexp.MustCompile(`^iam/?$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return "info", true
+	}},
+	{regexp.MustCompile(`^network/?$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return "interfaces/", true
+	}},
+	{regexp.MustCompile(`^network/interfaces/?$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		return "macs/", true
+	}},
+	{regexp.MustCompile(`^network/interfaces/macs/?$`), func(md InstanceMetadata, _ []string) (string, bool) {
+		if md.Mac == "" {
+			return "", false
+		}
+		return md.Mac + "/", true
+	}},
+	{regexp.MustCompile(`^network/interfaces/macs/([^/]+)/?$`), func(md InstanceMetadata, groups []string) (string, bool) {
+		if groups[1] != md.Mac {
+			return "", false
+		}
+		return "local-ipv4s\nmac\nsubnet-id\nvpc-id", true
+	}},
+	{regexp.MustCompile(`^network/interfaces/macs/([^/]+)/local-ipv4s$`), func(md InstanceMetadata, groups []string) (string, bool) {
+		if groups[1] != md.Mac || md.LocalIPv4 == "" {
+			return "", false
+		}
+		return md.LocalIPv4, true
+	}},
+	{regexp.MustCompile(`^network/interfaces/macs/([^/]+)/mac$`), func(md InstanceMetadata, groups []string) (string, bool) {
+		if groups[1] != md.Mac {
+			return "", false
+		}
+		return md.Mac, true
+	}},
+}
+
+// iamInfoResponse mirrors the JSON EC2 serves at
+// /latest/meta-data/iam/info, which clients use to discover that an
+// instance profile is attached before walking security-credentials/.
+type iamInfoResponse struct {
+	Code               string
+	LastUpdated        string
+	InstanceProfileArn string
+	InstanceProfileID  string
+}
+
+func (handler *httpHandler) serveMetadataRequest(writer http.ResponseWriter, request *http.Request, subpath string, role string, roleResolved bool, logger *logrus.Entry) {
+	md := handler.metadata.forRole(role)
+	if !roleResolved && (subpath == "iam" || subpath == "iam/" || subpath == "iam/info") {
+		logger.Debug("No IAM role for caller, 404ing iam/ path")
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if subpath == "iam/info" {
+		response, err := json.Marshal(&iamInfoResponse{
+			Code:               credentialCode,
+			LastUpdated:        time.Now().UTC().Format(time.RFC3339),
+			InstanceProfileArn: "arn:aws:iam::000000000000:instance-profile/" + role,
+			InstanceProfileID:  role,
+		})
+		if err != nil {
+			logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to serialize JSON")
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if _, err := writer.Write(response); err != nil {
+			logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to write response")
+		}
+		return
+	}
+	for _, entry := range metadataRegistry {
+		groups := entry.pattern.FindStringSubmatch(subpath)
+		if groups == nil {
+			continue
+		}
+		body, ok := entry.fetch(md, groups)
+		if !ok {
+			break
+		}
+		if _, err := writer.Write([]byte(body)); err != nil {
+			logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to write response")
+		}
+		return
+	}
+	logger.WithFields(logrus.Fields{"subpath": subpath}).Warn("Unknown metadata path")
+	writer.WriteHeader(http.StatusNotFound)
+}
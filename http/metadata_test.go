@@ -0,0 +1,62 @@
+package http
+
+import "testing"
+
+func TestMetadataConfigForRoleFallsBackToDefault(t *testing.T) {
+	config := MetadataConfig{
+		Default: InstanceMetadata{InstanceID: "i-default", Region: "us-east-1"},
+	}
+	got := config.forRole("unbound-role")
+	if got.InstanceID != "i-default" || got.Region != "us-east-1" {
+		t.Errorf("forRole with no override = %+v, want the Default values", got)
+	}
+}
+
+func TestMetadataConfigForRoleMergesOverride(t *testing.T) {
+	config := MetadataConfig{
+		Default: InstanceMetadata{
+			InstanceID:       "i-default",
+			InstanceType:     "t2.micro",
+			AvailabilityZone: "us-east-1a",
+			Region:           "us-east-1",
+		},
+		Overrides: map[string]InstanceMetadata{
+			"web": {InstanceID: "i-web", AvailabilityZone: "us-east-1b"},
+		},
+	}
+	got := config.forRole("web")
+	if got.InstanceID != "i-web" {
+		t.Errorf("forRole(web).InstanceID = %q, want the overridden value i-web", got.InstanceID)
+	}
+	if got.AvailabilityZone != "us-east-1b" {
+		t.Errorf("forRole(web).AvailabilityZone = %q, want the overridden value us-east-1b", got.AvailabilityZone)
+	}
+	if got.InstanceType != "t2.micro" {
+		t.Errorf("forRole(web).InstanceType = %q, want the Default value t2.micro to survive an unset override field", got.InstanceType)
+	}
+	if got.Region != "us-east-1" {
+		t.Errorf("forRole(web).Region = %q, want the Default value us-east-1 to survive an unset override field", got.Region)
+	}
+}
+
+func TestMergeMetadataPrefersOverrideFieldsOnly(t *testing.T) {
+	base := InstanceMetadata{
+		InstanceID:       "i-base",
+		InstanceType:     "t2.micro",
+		LocalIPv4:        "10.0.0.1",
+		PublicIPv4:       "203.0.113.1",
+		Mac:              "00:00:00:00:00:01",
+		AvailabilityZone: "us-east-1a",
+		Region:           "us-east-1",
+		Hostname:         "base-host",
+	}
+	override := InstanceMetadata{Hostname: "override-host"}
+	merged := mergeMetadata(base, override)
+	if merged.Hostname != "override-host" {
+		t.Errorf("merged.Hostname = %q, want the override value", merged.Hostname)
+	}
+	base.Hostname = "override-host"
+	if merged != base {
+		t.Errorf("merged = %+v, want every other field untouched from base: %+v", merged, base)
+	}
+}
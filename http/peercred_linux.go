@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package http
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// PeerCredConnContext is a http.Server ConnContext hook that performs the
+// getsockopt(SO_PEERCRED) lookup for a Unix-socket connection and stashes
+// the result under peerCredContextKey so peerCredIdentityResolver can read
+// it back out of each request's context. Wire it in with
+// http.Server{ConnContext: http.PeerCredConnContext} when the daemon is
+// bound to a Unix socket bind-mounted into each container.
+func PeerCredConnContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	syscallConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+	var ucred *syscall.Ucred
+	var controlErr error
+	err = syscallConn.Control(func(fd uintptr) {
+		ucred, controlErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || controlErr != nil || ucred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredContextKey{}, &peerCredentials{
+		PID: int(ucred.Pid),
+		UID: int(ucred.Uid),
+		GID: int(ucred.Gid),
+	})
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package http
+
+import (
+	"context"
+	"net"
+)
+
+// PeerCredConnContext is a no-op on platforms without SO_PEERCRED (only
+// Linux is supported); peerCredIdentityResolver will simply never find
+// credentials in the context there, so every request fails identity
+// resolution rather than misattributing one container's role to another.
+func PeerCredConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return ctx
+}
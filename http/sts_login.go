@@ -0,0 +1,367 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/swipely/iam-docker/iam"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginMethod = "POST"
+	// maxLoginBodyBytes bounds the size of the relayed sts:GetCallerIdentity
+	// request so a malicious caller can't use this endpoint to push an
+	// arbitrarily large body through the daemon.
+	maxLoginBodyBytes = 16 * 1024
+	arnBindingTTL     = 15 * time.Minute
+)
+
+// stsEndpoint is pinned server-side; the client's own notion of the request
+// URL is only trusted for its path and query, never its host, so a caller
+// can't redirect the relayed call anywhere but STS.
+var stsEndpoint = &url.URL{Scheme: "https", Host: "sts.amazonaws.com"}
+
+// PrincipalBinding maps an IAM principal ARN pattern (a glob, e.g.
+// "arn:aws:iam::123456789012:role/*") to the iam-docker role that callers
+// proving that identity should be issued credentials for.
+type PrincipalBinding struct {
+	Pattern string
+	Role    string
+}
+
+// LoginConfig configures the sts:GetCallerIdentity login endpoint.
+type LoginConfig struct {
+	// ServerIDHeader is the header name clients must sign and embed to
+	// prevent a relayed request from being replayed against some other
+	// iam-docker-alike endpoint.
+	ServerIDHeader string
+	// ServerID is the value ServerIDHeader must carry.
+	ServerID string
+	// Bindings maps principal ARN patterns to roles.
+	Bindings []PrincipalBinding
+}
+
+// loginRequest is the JSON body clients POST to /login/aws-iam. It mirrors
+// the fields of the well-established IAM-authentication pattern used by
+// Vault and Consul's aws-iam auth methods: the client signs a
+// sts:GetCallerIdentity request for itself and relays the pieces needed to
+// replay it, base64-encoded so arbitrary header/body bytes survive JSON.
+type loginRequest struct {
+	Method  string `json:"iam_http_request_method"`
+	URL     string `json:"iam_request_url"`
+	Body    string `json:"iam_request_body"`
+	Headers string `json:"iam_request_headers"`
+}
+
+type callerIdentity struct {
+	Arn     string
+	UserID  string
+	Account string
+}
+
+type getCallerIdentityResponse struct {
+	XMLName xml.Name `xml:"GetCallerIdentityResponse"`
+	Result  struct {
+		Arn     string `xml:"Arn"`
+		UserID  string `xml:"UserId"`
+		Account string `xml:"Account"`
+	} `xml:"GetCallerIdentityResult"`
+}
+
+// NewSTSLoginHandler creates a http.Handler, sibling to NewIAMHandler, which
+// exchanges a relayed sts:GetCallerIdentity call for credentials from
+// credentialStore. It lets non-Docker workloads (Nomad tasks, IRSA pods,
+// laptops with `aws sso`) obtain the same role credentials iam-docker vends
+// to local containers, proving their identity via IAM rather than IP.
+func NewSTSLoginHandler(config LoginConfig, credentialStore iam.CredentialStore) (http.Handler, error) {
+	bindings := make([]compiledBinding, 0, len(config.Bindings))
+	for _, binding := range config.Bindings {
+		pattern, err := globToRegexp(binding.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, compiledBinding{pattern: pattern, role: binding.Role})
+	}
+	return &stsLoginHandler{
+		config:          config,
+		bindings:        bindings,
+		credentialStore: credentialStore,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		cache:           newArnCache(),
+	}, nil
+}
+
+type compiledBinding struct {
+	pattern *regexp.Regexp
+	role    string
+}
+
+type stsLoginHandler struct {
+	config          LoginConfig
+	bindings        []compiledBinding
+	credentialStore iam.CredentialStore
+	client          *http.Client
+	cache           *arnCache
+}
+
+func (handler *stsLoginHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	logger := log.WithFields(logrus.Fields{
+		"path":   request.URL.Path,
+		"method": request.Method,
+	})
+	if request.Method != loginMethod {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body loginRequest
+	if err := json.NewDecoder(io.LimitReader(request.Body, maxLoginBodyBytes)).Decode(&body); err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to decode login request")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	role, err := handler.resolveRole(body, logger)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to authenticate signed identity")
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	logger = logger.WithFields(logrus.Fields{"role": role})
+	creds, err := handler.credentialStore.CredentialsForRole(role)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to find credentials")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response, err := json.Marshal(&credentialResponse{
+		AccessKeyID:     *creds.AccessKeyId,
+		Code:            credentialCode,
+		Expiration:      *creds.Expiration,
+		LastUpdated:     creds.Expiration.Add(-1 * time.Hour),
+		SecretAccessKey: *creds.SecretAccessKey,
+		Type:            credentialType,
+		Token:           *creds.SessionToken,
+	})
+	if err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to serialize JSON")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := writer.Write(response); err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to write response")
+	}
+}
+
+// resolveRole relays the client's signed GetCallerIdentity call to STS,
+// validates the returned principal against the configured bindings, and
+// returns the role it's bound to.
+func (handler *stsLoginHandler) resolveRole(body loginRequest, logger *logrus.Entry) (string, error) {
+	identity, err := handler.verifyCallerIdentity(body)
+	if err != nil {
+		return "", err
+	}
+	if role, ok := handler.cache.get(identity.Arn); ok {
+		return role, nil
+	}
+	for _, binding := range handler.bindings {
+		if binding.pattern.MatchString(identity.Arn) {
+			handler.cache.put(identity.Arn, binding.role, arnBindingTTL)
+			return binding.role, nil
+		}
+	}
+	return "", errors.New("principal " + identity.Arn + " is not bound to any role")
+}
+
+func (handler *stsLoginHandler) verifyCallerIdentity(body loginRequest) (*callerIdentity, error) {
+	if body.Method != "POST" {
+		return nil, errors.New("iam_http_request_method must be POST")
+	}
+	rawHeaders, err := base64.StdEncoding.DecodeString(body.Headers)
+	if err != nil {
+		return nil, err
+	}
+	var headers map[string][]string
+	if err := json.Unmarshal(rawHeaders, &headers); err != nil {
+		return nil, err
+	}
+	authorization, ok := headerValue(headers, "Authorization")
+	if !ok {
+		return nil, errors.New("missing Authorization header")
+	}
+	signedHeaders, err := signedHeaderNames(authorization)
+	if err != nil {
+		return nil, err
+	}
+	if !signedHeadersInclude(signedHeaders, handler.config.ServerIDHeader) {
+		return nil, errors.New(handler.config.ServerIDHeader + " must be part of the signed request (SignedHeaders)")
+	}
+	if !headerEquals(headers, handler.config.ServerIDHeader, handler.config.ServerID) {
+		return nil, errors.New("missing or incorrect " + handler.config.ServerIDHeader + " header")
+	}
+	rawURL, err := base64.StdEncoding.DecodeString(body.URL)
+	if err != nil {
+		return nil, err
+	}
+	clientURL, err := url.Parse(string(rawURL))
+	if err != nil {
+		return nil, err
+	}
+	requestBody, err := base64.StdEncoding.DecodeString(body.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(requestBody) > maxLoginBodyBytes {
+		return nil, errors.New("iam_request_body exceeds the maximum allowed size")
+	}
+	pinnedURL := &url.URL{
+		Scheme:   stsEndpoint.Scheme,
+		Host:     stsEndpoint.Host,
+		Path:     clientURL.Path,
+		RawQuery: clientURL.RawQuery,
+	}
+	proxyRequest, err := http.NewRequest(loginMethod, pinnedURL.String(), bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	proxyRequest.Host = stsEndpoint.Host
+	for name, values := range headers {
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
+		for _, value := range values {
+			proxyRequest.Header.Add(name, value)
+		}
+	}
+	response, err := handler.client.Do(proxyRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("sts:GetCallerIdentity was rejected: " + string(responseBody))
+	}
+	var parsed getCallerIdentityResponse
+	if err := xml.Unmarshal(responseBody, &parsed); err != nil {
+		return nil, err
+	}
+	return &callerIdentity{
+		Arn:     parsed.Result.Arn,
+		UserID:  parsed.Result.UserID,
+		Account: parsed.Result.Account,
+	}, nil
+}
+
+func headerEquals(headers map[string][]string, name, expected string) bool {
+	for candidate, values := range headers {
+		if !strings.EqualFold(candidate, name) {
+			continue
+		}
+		for _, value := range values {
+			if value == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// headerValue returns the first value of the named header, matched
+// case-insensitively, as relayed headers are a plain JSON map rather than a
+// canonical http.Header.
+func headerValue(headers map[string][]string, name string) (string, bool) {
+	for candidate, values := range headers {
+		if strings.EqualFold(candidate, name) && len(values) > 0 {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+// signedHeaderNames extracts the SigV4 SignedHeaders list from an
+// Authorization header value, e.g.
+// "AWS4-HMAC-SHA256 Credential=..., SignedHeaders=host;x-amz-date;x-iam-docker-server-id, Signature=...".
+func signedHeaderNames(authorization string) ([]string, error) {
+	const marker = "SignedHeaders="
+	index := strings.Index(authorization, marker)
+	if index == -1 {
+		return nil, errors.New("Authorization header is missing SignedHeaders")
+	}
+	rest := authorization[index+len(marker):]
+	if comma := strings.IndexByte(rest, ','); comma != -1 {
+		rest = rest[:comma]
+	}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return nil, errors.New("Authorization header has an empty SignedHeaders list")
+	}
+	return strings.Split(rest, ";"), nil
+}
+
+// signedHeadersInclude reports whether name (matched case-insensitively, as
+// SigV4 lower-cases header names) appears in signedHeaders.
+func signedHeadersInclude(signedHeaders []string, name string) bool {
+	for _, signed := range signedHeaders {
+		if strings.EqualFold(signed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp compiles a simple glob pattern (only "*" is special) into an
+// anchored regexp for matching principal ARNs.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	parts := strings.Split(pattern, "*")
+	for index, part := range parts {
+		parts[index] = regexp.QuoteMeta(part)
+	}
+	return regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// arnCache caches successful ARN -> role bindings for a short TTL so that a
+// principal seen recently is not matched against the bindings again. It is
+// keyed by the ARN STS returns, so every request still makes its own
+// sts:GetCallerIdentity round-trip.
+type arnCache struct {
+	mutex   sync.Mutex
+	entries map[string]arnCacheEntry
+}
+
+type arnCacheEntry struct {
+	role   string
+	expiry time.Time
+}
+
+func newArnCache() *arnCache {
+	return &arnCache{entries: make(map[string]arnCacheEntry)}
+}
+
+func (cache *arnCache) get(arn string) (string, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[arn]
+	if !ok || time.Now().After(entry.expiry) {
+		return "", false
+	}
+	return entry.role, true
+}
+
+func (cache *arnCache) put(arn, role string, ttl time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries[arn] = arnCacheEntry{role: role, expiry: time.Now().Add(ttl)}
+}
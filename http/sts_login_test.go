@@ -0,0 +1,123 @@
+package http
+
+import "testing"
+
+func TestSignedHeaderNames(t *testing.T) {
+	cases := []struct {
+		name          string
+		authorization string
+		want          []string
+		wantErr       bool
+	}{
+		{
+			name:          "typical sigv4 header",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/sts/aws4_request, SignedHeaders=host;x-amz-date;x-iam-docker-server-id, Signature=deadbeef",
+			want:          []string{"host", "x-amz-date", "x-iam-docker-server-id"},
+		},
+		{
+			name:          "single signed header",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/sts/aws4_request, SignedHeaders=host, Signature=deadbeef",
+			want:          []string{"host"},
+		},
+		{
+			name:          "missing SignedHeaders",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/sts/aws4_request, Signature=deadbeef",
+			wantErr:       true,
+		},
+		{
+			name:          "empty SignedHeaders",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/sts/aws4_request, SignedHeaders=, Signature=deadbeef",
+			wantErr:       true,
+		},
+		{
+			name:          "empty string",
+			authorization: "",
+			wantErr:       true,
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			got, err := signedHeaderNames(testCase.authorization)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatalf("signedHeaderNames(%q) = %v, want error", testCase.authorization, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("signedHeaderNames(%q) returned unexpected error: %v", testCase.authorization, err)
+			}
+			if len(got) != len(testCase.want) {
+				t.Fatalf("signedHeaderNames(%q) = %v, want %v", testCase.authorization, got, testCase.want)
+			}
+			for i := range got {
+				if got[i] != testCase.want[i] {
+					t.Fatalf("signedHeaderNames(%q) = %v, want %v", testCase.authorization, got, testCase.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSignedHeadersInclude(t *testing.T) {
+	signedHeaders := []string{"host", "x-amz-date", "x-iam-docker-server-id"}
+	cases := []struct {
+		name string
+		want bool
+	}{
+		{"X-Iam-Docker-Server-Id", true},
+		{"x-iam-docker-server-id", true},
+		{"HOST", true},
+		{"x-amz-content-sha256", false},
+	}
+	for _, testCase := range cases {
+		if got := signedHeadersInclude(signedHeaders, testCase.name); got != testCase.want {
+			t.Errorf("signedHeadersInclude(%v, %q) = %v, want %v", signedHeaders, testCase.name, got, testCase.want)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	cases := []struct {
+		pattern string
+		arn     string
+		want    bool
+	}{
+		{"arn:aws:iam::123456789012:role/*", "arn:aws:iam::123456789012:role/deploy", true},
+		{"arn:aws:iam::123456789012:role/*", "arn:aws:iam::999999999999:role/deploy", false},
+		{"arn:aws:iam::123456789012:role/ci-*", "arn:aws:iam::123456789012:role/ci-build", true},
+		{"arn:aws:iam::123456789012:role/ci-*", "arn:aws:iam::123456789012:role/other", false},
+		{"arn:aws:iam::123456789012:role/deploy", "arn:aws:iam::123456789012:role/deploy", true},
+		{"arn:aws:iam::123456789012:role/deploy", "arn:aws:iam::123456789012:role/deployment", false},
+		{"arn:aws:iam::*:role/*", "arn:aws:iam::123456789012:role/anything", true},
+	}
+	for _, testCase := range cases {
+		pattern, err := globToRegexp(testCase.pattern)
+		if err != nil {
+			t.Fatalf("globToRegexp(%q) returned unexpected error: %v", testCase.pattern, err)
+		}
+		if got := pattern.MatchString(testCase.arn); got != testCase.want {
+			t.Errorf("globToRegexp(%q).MatchString(%q) = %v, want %v", testCase.pattern, testCase.arn, got, testCase.want)
+		}
+	}
+}
+
+func TestHeaderEqualsAndHeaderValue(t *testing.T) {
+	headers := map[string][]string{
+		"X-Iam-Docker-Server-Id": {"production"},
+		"Authorization":          {"AWS4-HMAC-SHA256 ..."},
+	}
+	if !headerEquals(headers, "x-iam-docker-server-id", "production") {
+		t.Error("headerEquals should match case-insensitively")
+	}
+	if headerEquals(headers, "x-iam-docker-server-id", "staging") {
+		t.Error("headerEquals should not match a different value")
+	}
+	value, ok := headerValue(headers, "authorization")
+	if !ok || value != "AWS4-HMAC-SHA256 ..." {
+		t.Errorf("headerValue(authorization) = %q, %v, want the Authorization value, true", value, ok)
+	}
+	if _, ok := headerValue(headers, "x-amz-date"); ok {
+		t.Error("headerValue should report absent headers as not found")
+	}
+}
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenPathRegex matches the versioned path IMDSv2 clients PUT to mint a
+// session token, e.g. /latest/api/token.
+var tokenPathRegex = regexp.MustCompile("^/[^/]+/api/token$")
+
+const (
+	// tokenHeader is the header clients send a minted token back in.
+	tokenHeader = "X-aws-ec2-metadata-token"
+	// tokenTTLHeader is the header clients set on the PUT /latest/api/token
+	// request to request a token lifetime.
+	tokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	// tokenMethod is the HTTP method IMDSv2 clients use to mint a token.
+	tokenMethod = "PUT"
+	// defaultTokenTTL is used when a client omits the TTL header.
+	defaultTokenTTL = 6 * time.Hour
+	// maxTokenTTL mirrors the real IMDS limit of 6 hours.
+	maxTokenTTL = 6 * time.Hour
+	// tokenSweepInterval is how often expired tokens are purged from the store.
+	tokenSweepInterval = time.Minute
+)
+
+// imdsVersion controls whether the daemon accepts IMDSv1-style unauthenticated
+// GETs, requires a valid IMDSv2 token, or allows both.
+type imdsVersion string
+
+const (
+	imdsV1   imdsVersion = "v1"
+	imdsV2   imdsVersion = "v2"
+	imdsBoth imdsVersion = "both"
+)
+
+// tokenStore is a concurrency-safe store of IMDSv2 session tokens, keyed by
+// the opaque token string. It is independent of the container and credential
+// stores since tokens authenticate a caller, not a container identity.
+type tokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]time.Time
+}
+
+// newTokenStore creates an empty tokenStore and starts its background
+// sweeper, which periodically purges expired tokens so the map doesn't grow
+// unbounded under sustained traffic.
+func newTokenStore() *tokenStore {
+	store := &tokenStore{tokens: make(map[string]time.Time)}
+	go store.sweep()
+	return store
+}
+
+// mint generates a new random token, stores it with the given TTL, and
+// returns it.
+func (store *tokenStore) mint(ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	store.mutex.Lock()
+	store.tokens[token] = time.Now().Add(ttl)
+	store.mutex.Unlock()
+	return token, nil
+}
+
+// valid reports whether token exists in the store and has not yet expired.
+func (store *tokenStore) valid(token string) bool {
+	if token == "" {
+		return false
+	}
+	store.mutex.Lock()
+	expiry, ok := store.tokens[token]
+	store.mutex.Unlock()
+	return ok && time.Now().Before(expiry)
+}
+
+// parseTokenTTL reads the ttl header, falling back to defaultTokenTTL and
+// clamping to maxTokenTTL, matching the real IMDSv2 PUT /latest/api/token
+// behaviour.
+func parseTokenTTL(header string) time.Duration {
+	if header == "" {
+		return defaultTokenTTL
+	}
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds <= 0 {
+		return defaultTokenTTL
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl > maxTokenTTL {
+		return maxTokenTTL
+	}
+	return ttl
+}
+
+func (store *tokenStore) sweep() {
+	for range time.Tick(tokenSweepInterval) {
+		now := time.Now()
+		store.mutex.Lock()
+		for token, expiry := range store.tokens {
+			if now.After(expiry) {
+				delete(store.tokens, token)
+			}
+		}
+		store.mutex.Unlock()
+	}
+}
+
+// serveTokenRequest mints a new IMDSv2 session token and returns it as
+// text/plain, the same shape real EC2 uses for PUT /latest/api/token.
+func (handler *httpHandler) serveTokenRequest(writer http.ResponseWriter, request *http.Request, logger *logrus.Entry) {
+	ttl := parseTokenTTL(request.Header.Get(tokenTTLHeader))
+	token, err := handler.tokens.mint(ttl)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to mint IMDSv2 token")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := writer.Write([]byte(token)); err != nil {
+		logger.WithFields(logrus.Fields{"error": err.Error()}).Warn("Unable to write response")
+	}
+}
+
+// requiresValidToken reports whether the request must carry a valid,
+// unexpired IMDSv2 token before handler will serve it, based on the
+// configured --imds-version mode.
+func (handler *httpHandler) requiresValidToken(request *http.Request) bool {
+	if handler.imdsVersion != imdsV2 {
+		return false
+	}
+	return !handler.tokens.valid(request.Header.Get(tokenHeader))
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenStoreMintAndValid(t *testing.T) {
+	store := &tokenStore{tokens: make(map[string]time.Time)}
+	token, err := store.mint(time.Hour)
+	if err != nil {
+		t.Fatalf("mint returned unexpected error: %v", err)
+	}
+	if token == "" {
+		t.Fatal("mint returned an empty token")
+	}
+	if !store.valid(token) {
+		t.Error("a freshly minted token should be valid")
+	}
+	other, err := store.mint(time.Hour)
+	if err != nil {
+		t.Fatalf("mint returned unexpected error: %v", err)
+	}
+	if token == other {
+		t.Error("mint should not return the same token twice")
+	}
+}
+
+func TestTokenStoreValidRejectsUnknownOrEmpty(t *testing.T) {
+	store := &tokenStore{tokens: make(map[string]time.Time)}
+	if store.valid("") {
+		t.Error("an empty token should never be valid")
+	}
+	if store.valid("not-a-real-token") {
+		t.Error("an unminted token should not be valid")
+	}
+}
+
+func TestTokenStoreValidExpires(t *testing.T) {
+	store := &tokenStore{tokens: make(map[string]time.Time)}
+	token, err := store.mint(-time.Second)
+	if err != nil {
+		t.Fatalf("mint returned unexpected error: %v", err)
+	}
+	if store.valid(token) {
+		t.Error("a token minted with a TTL in the past should already be invalid")
+	}
+}
+
+func TestParseTokenTTL(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{"empty header defaults", "", defaultTokenTTL},
+		{"valid ttl", "60", 60 * time.Second},
+		{"zero clamps to default", "0", defaultTokenTTL},
+		{"negative clamps to default", "-5", defaultTokenTTL},
+		{"non-numeric clamps to default", "soon", defaultTokenTTL},
+		{"over the max clamps to max", "999999", maxTokenTTL},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if got := parseTokenTTL(testCase.header); got != testCase.want {
+				t.Errorf("parseTokenTTL(%q) = %v, want %v", testCase.header, got, testCase.want)
+			}
+		})
+	}
+}